@@ -0,0 +1,123 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package auth implements the legacy RFC 1305 symmetric-key authentication
+// scheme still used by NTPv3 clients: a keyed MD5 or SHA1 digest of the NTP
+// header, computed under a secret shared out of band and identified by a
+// 32-bit key ID.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/md5"  //nolint:gosec // required by the legacy NTPv3 MAC scheme.
+	"crypto/sha1" //nolint:gosec // required by the legacy NTPv3 MAC scheme.
+	"errors"
+	"fmt"
+	"hash"
+
+	"github.com/OpenPSG/sntp/types"
+)
+
+// Algorithm identifies the digest algorithm used to compute a Key's MAC.
+type Algorithm uint8
+
+const (
+	// AlgorithmMD5 computes a 16-byte digest.
+	AlgorithmMD5 Algorithm = iota
+	// AlgorithmSHA1 computes a 20-byte digest.
+	AlgorithmSHA1
+)
+
+func (a Algorithm) new() (hash.Hash, error) {
+	switch a {
+	case AlgorithmMD5:
+		return md5.New(), nil
+	case AlgorithmSHA1:
+		return sha1.New(), nil
+	default:
+		return nil, fmt.Errorf("auth: unknown algorithm %d", a)
+	}
+}
+
+// Key is a single symmetric key in a KeyStore.
+type Key struct {
+	Algorithm Algorithm
+	Secret    []byte
+}
+
+// ErrUnknownKey is returned when a MAC references a key ID the KeyStore
+// doesn't have. The caller should treat this the same as ntpd: reject the
+// request with a Kiss-of-Death NKEY.
+var ErrUnknownKey = errors.New("auth: unknown key ID")
+
+// ErrInvalidMAC is returned when a MAC fails to verify against the header it
+// was supposedly computed over. The caller should reject the request with a
+// Kiss-of-Death CRYP.
+var ErrInvalidMAC = errors.New("auth: MAC verification failed")
+
+// KeyStore holds the set of symmetric keys a server trusts for legacy
+// RFC 1305 authentication, indexed by key ID.
+type KeyStore struct {
+	keys map[uint32]Key
+}
+
+// NewKeyStore returns a KeyStore serving the given keys, indexed by key ID.
+func NewKeyStore(keys map[uint32]Key) *KeyStore {
+	return &KeyStore{keys: keys}
+}
+
+// Verify checks mac against header, the 48-byte RFC 4330 portion of the
+// packet it authenticates. It returns ErrUnknownKey if mac.KeyID isn't in
+// the store, or ErrInvalidMAC if the digest doesn't match.
+func (s *KeyStore) Verify(mac *types.MAC, header []byte) error {
+	key, ok := s.keys[mac.KeyID]
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	digest, err := digest(key, header)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(digest, mac.Digest) {
+		return ErrInvalidMAC
+	}
+
+	return nil
+}
+
+// Sign computes a MAC for header under keyID. It returns ErrUnknownKey if
+// keyID isn't in the store, so a response can reuse the same key ID a
+// client's request authenticated with.
+func (s *KeyStore) Sign(keyID uint32, header []byte) (*types.MAC, error) {
+	key, ok := s.keys[keyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	d, err := digest(key, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.MAC{KeyID: keyID, Digest: d}, nil
+}
+
+// digest computes the keyed digest of header under key, per RFC 1305
+// Appendix C: the secret prepended to the data, then hashed as a whole.
+func digest(key Key, header []byte) ([]byte, error) {
+	h, err := key.Algorithm.new()
+	if err != nil {
+		return nil, err
+	}
+	h.Write(key.Secret)
+	h.Write(header)
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,65 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package auth_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/OpenPSG/sntp/auth"
+	"github.com/OpenPSG/sntp/types"
+)
+
+func TestKeyStoreSignAndVerify(t *testing.T) {
+	for _, alg := range []auth.Algorithm{auth.AlgorithmMD5, auth.AlgorithmSHA1} {
+		store := auth.NewKeyStore(map[uint32]auth.Key{
+			1: {Algorithm: alg, Secret: []byte("super-secret")},
+		})
+
+		header := make([]byte, types.PacketHeaderSize)
+		for i := range header {
+			header[i] = byte(i)
+		}
+
+		mac, err := store.Sign(1, header)
+		require.NoError(t, err)
+		require.Equal(t, uint32(1), mac.KeyID)
+
+		require.NoError(t, store.Verify(mac, header))
+	}
+}
+
+func TestKeyStoreVerifyRejectsUnknownKey(t *testing.T) {
+	store := auth.NewKeyStore(map[uint32]auth.Key{
+		1: {Algorithm: auth.AlgorithmMD5, Secret: []byte("super-secret")},
+	})
+
+	_, err := store.Sign(2, make([]byte, types.PacketHeaderSize))
+	require.ErrorIs(t, err, auth.ErrUnknownKey)
+
+	err = store.Verify(&types.MAC{KeyID: 2, Digest: make([]byte, 16)}, make([]byte, types.PacketHeaderSize))
+	require.ErrorIs(t, err, auth.ErrUnknownKey)
+}
+
+func TestKeyStoreVerifyRejectsBadDigest(t *testing.T) {
+	store := auth.NewKeyStore(map[uint32]auth.Key{
+		1: {Algorithm: auth.AlgorithmMD5, Secret: []byte("super-secret")},
+	})
+
+	header := make([]byte, types.PacketHeaderSize)
+	mac, err := store.Sign(1, header)
+	require.NoError(t, err)
+
+	mac.Digest[0] ^= 0xFF
+
+	err = store.Verify(mac, header)
+	require.ErrorIs(t, err, auth.ErrInvalidMAC)
+}
@@ -0,0 +1,37 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package metrics_test
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/OpenPSG/sntp"
+	"github.com/OpenPSG/sntp/metrics"
+)
+
+// This example wires a Collector into the server and exposes it for
+// scraping alongside the UDP listener.
+func Example() {
+	collector := metrics.NewCollector()
+	prometheus.MustRegister(collector)
+
+	go func() {
+		http.Handle("/metrics", promhttp.Handler())
+		log.Fatal(http.ListenAndServe(":9100", nil))
+	}()
+
+	srv := sntp.NewServer(sntp.WithRecorder(collector))
+	log.Fatal(srv.ListenAndServe(context.Background(), ":123"))
+}
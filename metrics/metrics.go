@@ -0,0 +1,196 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package metrics provides operational instrumentation for an sntp.Server.
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "sntp"
+
+// Recorder receives instrumentation events as a Server processes requests.
+// Implementations must be safe for concurrent use.
+type Recorder interface {
+	// RequestReceived is called for every UDP datagram read off the wire,
+	// before it is validated.
+	RequestReceived()
+	// MalformedPacket is called when a request could not be decoded, or was
+	// the wrong size.
+	MalformedPacket()
+	// RateLimited is called when a request is rejected for exceeding the
+	// per-client rate limit.
+	RateLimited()
+	// KissOfDeathSent is called whenever a Kiss-of-Death response is sent,
+	// labeled with its 4-character kiss code.
+	KissOfDeathSent(code string)
+	// RequestServed is called after a normal response has been sent, with
+	// the stratum, root delay, and root dispersion advertised in it, and
+	// the time elapsed between receiving the request and transmitting the
+	// response.
+	RequestServed(stratum uint8, rootDelay, rootDispersion, latency time.Duration)
+	// UpstreamSynced is called whenever the server successfully
+	// synchronizes with an upstream NTP server.
+	UpstreamSynced()
+}
+
+// NoOp is a Recorder that discards all events. It is the default used by a
+// Server that isn't configured with sntp.WithRecorder.
+type NoOp struct{}
+
+func (NoOp) RequestReceived()                                                 {}
+func (NoOp) MalformedPacket()                                                 {}
+func (NoOp) RateLimited()                                                     {}
+func (NoOp) KissOfDeathSent(string)                                           {}
+func (NoOp) RequestServed(uint8, time.Duration, time.Duration, time.Duration) {}
+func (NoOp) UpstreamSynced()                                                  {}
+
+// Collector is a Recorder that also implements prometheus.Collector,
+// exposing the recorded events as Prometheus counters, gauges, and a
+// histogram. Register it with a prometheus.Registerer and pass it to
+// sntp.WithRecorder.
+type Collector struct {
+	requestsReceived    prometheus.Counter
+	requestsServed      prometheus.Counter
+	requestsRateLimited prometheus.Counter
+	malformedPackets    prometheus.Counter
+	kissOfDeathSent     *prometheus.CounterVec
+	requestLatency      prometheus.Histogram
+
+	currentStratum        prometheus.Gauge
+	rootDelaySeconds      prometheus.Gauge
+	rootDispersionSeconds prometheus.Gauge
+
+	lastSyncDesc *prometheus.Desc
+
+	mu       sync.Mutex
+	synced   bool
+	lastSync time.Time
+}
+
+// NewCollector returns a Collector with all of its metrics initialized.
+func NewCollector() *Collector {
+	return &Collector{
+		requestsReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_received_total",
+			Help:      "Total number of SNTP requests received.",
+		}),
+		requestsServed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_served_total",
+			Help:      "Total number of SNTP requests successfully served.",
+		}),
+		requestsRateLimited: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_rate_limited_total",
+			Help:      "Total number of requests rejected for exceeding the per-client rate limit.",
+		}),
+		malformedPackets: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "malformed_packets_total",
+			Help:      "Total number of packets that could not be decoded as an SNTP request.",
+		}),
+		kissOfDeathSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "kiss_of_death_sent_total",
+			Help:      "Total number of Kiss-of-Death responses sent, by kiss code.",
+		}, []string{"code"}),
+		requestLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_latency_seconds",
+			Help:      "Time between receiving a request and transmitting its response.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		currentStratum: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "stratum",
+			Help:      "The stratum currently being advertised to clients.",
+		}),
+		rootDelaySeconds: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "root_delay_seconds",
+			Help:      "The root delay currently being advertised to clients, in seconds.",
+		}),
+		rootDispersionSeconds: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "root_dispersion_seconds",
+			Help:      "The root dispersion currently being advertised to clients, in seconds.",
+		}),
+		lastSyncDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "seconds_since_last_sync"),
+			"Seconds since the last successful upstream synchronization. Absent if the server has never synchronized.",
+			nil, nil,
+		),
+	}
+}
+
+func (c *Collector) RequestReceived() { c.requestsReceived.Inc() }
+
+func (c *Collector) MalformedPacket() { c.malformedPackets.Inc() }
+
+func (c *Collector) RateLimited() { c.requestsRateLimited.Inc() }
+
+func (c *Collector) KissOfDeathSent(code string) {
+	c.kissOfDeathSent.WithLabelValues(code).Inc()
+}
+
+func (c *Collector) RequestServed(stratum uint8, rootDelay, rootDispersion, latency time.Duration) {
+	c.requestsServed.Inc()
+	c.currentStratum.Set(float64(stratum))
+	c.rootDelaySeconds.Set(rootDelay.Seconds())
+	c.rootDispersionSeconds.Set(rootDispersion.Seconds())
+	c.requestLatency.Observe(latency.Seconds())
+}
+
+func (c *Collector) UpstreamSynced() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.synced = true
+	c.lastSync = time.Now()
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.requestsReceived.Describe(ch)
+	c.requestsServed.Describe(ch)
+	c.requestsRateLimited.Describe(ch)
+	c.malformedPackets.Describe(ch)
+	c.kissOfDeathSent.Describe(ch)
+	c.requestLatency.Describe(ch)
+	c.currentStratum.Describe(ch)
+	c.rootDelaySeconds.Describe(ch)
+	c.rootDispersionSeconds.Describe(ch)
+	ch <- c.lastSyncDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.requestsReceived.Collect(ch)
+	c.requestsServed.Collect(ch)
+	c.requestsRateLimited.Collect(ch)
+	c.malformedPackets.Collect(ch)
+	c.kissOfDeathSent.Collect(ch)
+	c.requestLatency.Collect(ch)
+	c.currentStratum.Collect(ch)
+	c.rootDelaySeconds.Collect(ch)
+	c.rootDispersionSeconds.Collect(ch)
+
+	c.mu.Lock()
+	synced, lastSync := c.synced, c.lastSync
+	c.mu.Unlock()
+
+	if synced {
+		ch <- prometheus.MustNewConstMetric(c.lastSyncDesc, prometheus.GaugeValue, time.Since(lastSync).Seconds())
+	}
+}
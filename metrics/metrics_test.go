@@ -0,0 +1,42 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package metrics_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OpenPSG/sntp/metrics"
+)
+
+func TestCollector(t *testing.T) {
+	c := metrics.NewCollector()
+
+	// Before any sync has happened, the last-sync gauge should be absent.
+	require.Equal(t, 0, testutil.CollectAndCount(c, "sntp_seconds_since_last_sync"))
+
+	c.RequestReceived()
+	c.MalformedPacket()
+	c.RateLimited()
+	c.KissOfDeathSent("RATE")
+	c.RequestServed(2, 10*time.Millisecond, 5*time.Millisecond, time.Millisecond)
+	c.UpstreamSynced()
+
+	require.Equal(t, 1, testutil.CollectAndCount(c, "sntp_requests_received_total"))
+	require.Equal(t, 1, testutil.CollectAndCount(c, "sntp_malformed_packets_total"))
+	require.Equal(t, 1, testutil.CollectAndCount(c, "sntp_requests_rate_limited_total"))
+	require.Equal(t, 1, testutil.CollectAndCount(c, "sntp_kiss_of_death_sent_total"))
+	require.Equal(t, 1, testutil.CollectAndCount(c, "sntp_requests_served_total"))
+	require.Equal(t, 1, testutil.CollectAndCount(c, "sntp_stratum"))
+	require.Equal(t, 1, testutil.CollectAndCount(c, "sntp_seconds_since_last_sync"))
+}
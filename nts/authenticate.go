@@ -0,0 +1,207 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package nts
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	siv "github.com/secure-io/siv-go"
+
+	"github.com/OpenPSG/sntp/types"
+)
+
+// ErrUnauthenticated is returned by Protect when a request's NTS Cookie or
+// Authenticator extension field is missing, malformed, or fails to verify.
+var ErrUnauthenticated = errors.New("nts: request failed authentication")
+
+// Protect verifies the NTS Cookie and Authenticator extension fields carried
+// by an NTP client request, and, if they check out, appends a fresh cookie
+// and authenticator to resp so the client can continue the NTS association
+// on its next request. It returns ErrUnauthenticated (or, if the cookie's
+// master key has since rotated out, ErrUnknownCookieKey) without modifying
+// resp if verification fails.
+func Protect(keys *MasterKeyStore, resp, req *types.Packet) error {
+	cookieEF, ok := req.Extension(types.ExtensionFieldTypeNTSCookie)
+	if !ok {
+		return fmt.Errorf("%w: no NTS Cookie extension field", ErrUnauthenticated)
+	}
+
+	c2s, s2c, err := keys.DecodeCookie(cookieEF.Value)
+	if err != nil {
+		if errors.Is(err, ErrUnknownCookieKey) {
+			return err
+		}
+		return fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+
+	authEF, ok := req.Extension(types.ExtensionFieldTypeNTSAuthenticator)
+	if !ok {
+		return fmt.Errorf("%w: no NTS Authenticator extension field", ErrUnauthenticated)
+	}
+
+	associatedData, err := authenticatedPrefix(req)
+	if err != nil {
+		return err
+	}
+
+	if _, err := openAuthenticator(c2s, authEF.Value, associatedData); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+
+	// Mint one fresh cookie to replace the one just spent, plus one more for
+	// every placeholder the client sent asking us to keep its cookie supply
+	// topped up.
+	numCookies := 1
+	for _, ef := range req.Extensions {
+		if ef.Type == types.ExtensionFieldTypeNTSCookiePlaceholder {
+			numCookies++
+		}
+	}
+
+	var encrypted []types.ExtensionField
+	for i := 0; i < numCookies; i++ {
+		cookie, err := keys.EncodeCookie(c2s, s2c)
+		if err != nil {
+			return err
+		}
+		encrypted = append(encrypted, types.ExtensionField{
+			Type:  types.ExtensionFieldTypeNTSCookie,
+			Value: cookie,
+		})
+	}
+
+	if uid, ok := req.Extension(types.ExtensionFieldTypeUniqueIdentifier); ok {
+		resp.Extensions = append(resp.Extensions, uid)
+	}
+
+	plaintext, err := types.MarshalExtensionFields(encrypted)
+	if err != nil {
+		return err
+	}
+
+	respHeader, err := resp.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	authValue, err := sealAuthenticator(s2c, plaintext, respHeader)
+	if err != nil {
+		return err
+	}
+
+	resp.Extensions = append(resp.Extensions, types.ExtensionField{
+		Type:  types.ExtensionFieldTypeNTSAuthenticator,
+		Value: authValue,
+	})
+
+	return nil
+}
+
+// authenticatedPrefix re-encodes the portion of req that its Authenticator
+// extension field covers: the NTP header plus every extension field that
+// precedes it.
+func authenticatedPrefix(req *types.Packet) ([]byte, error) {
+	var preceding []types.ExtensionField
+	for _, ef := range req.Extensions {
+		if ef.Type == types.ExtensionFieldTypeNTSAuthenticator {
+			break
+		}
+		preceding = append(preceding, ef)
+	}
+
+	prefix := *req
+	prefix.Extensions = preceding
+	return prefix.MarshalBinary()
+}
+
+// sealAuthenticator AEAD-encrypts plaintext (the encrypted extension fields
+// to include alongside the response, if any) under key, binding it to
+// associatedData (the NTP header and every extension field preceding the
+// Authenticator). The result is the Authenticator extension field's Value,
+// laid out per RFC 8915 §5.6.
+func sealAuthenticator(key, plaintext, associatedData []byte) ([]byte, error) {
+	aead, err := siv.NewCMAC(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("nts: error generating authenticator nonce: %w", err)
+	}
+
+	// siv-go's AES-NI implementation misbehaves when given byte slices with
+	// spare capacity, so clone plaintext/associatedData before passing them
+	// in; see the matching note in cookie.go.
+	ciphertext := aead.Seal(nil, nonce, clone(plaintext), clone(associatedData))
+
+	return encodeAuthenticatorValue(nonce, ciphertext), nil
+}
+
+// openAuthenticator reverses sealAuthenticator, returning the decrypted
+// encrypted extension fields, if any.
+func openAuthenticator(key, value, associatedData []byte) ([]byte, error) {
+	aead, err := siv.NewCMAC(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, ciphertext, err := decodeAuthenticatorValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, nonce, ciphertext, clone(associatedData))
+}
+
+// encodeAuthenticatorValue lays out nonce and ciphertext as the NTS
+// Authenticator and Encrypted Extension Fields' Value, per RFC 8915 §5.6: a
+// 2-byte Nonce Length, a 2-byte Ciphertext Length, the nonce padded to a
+// multiple of 4 bytes, then the ciphertext padded the same way.
+func encodeAuthenticatorValue(nonce, ciphertext []byte) []byte {
+	paddedNonceLen := pad4(len(nonce))
+	paddedCiphertextLen := pad4(len(ciphertext))
+
+	value := make([]byte, 4+paddedNonceLen+paddedCiphertextLen)
+	binary.BigEndian.PutUint16(value[0:2], uint16(len(nonce)))
+	binary.BigEndian.PutUint16(value[2:4], uint16(len(ciphertext)))
+	copy(value[4:], nonce)
+	copy(value[4+paddedNonceLen:], ciphertext)
+	return value
+}
+
+// decodeAuthenticatorValue reverses encodeAuthenticatorValue.
+func decodeAuthenticatorValue(value []byte) (nonce, ciphertext []byte, err error) {
+	if len(value) < 4 {
+		return nil, nil, errors.New("nts: authenticator too short")
+	}
+
+	nonceLen := int(binary.BigEndian.Uint16(value[0:2]))
+	ciphertextLen := int(binary.BigEndian.Uint16(value[2:4]))
+
+	paddedNonceLen := pad4(nonceLen)
+	paddedCiphertextLen := pad4(ciphertextLen)
+
+	if len(value) < 4+paddedNonceLen+paddedCiphertextLen {
+		return nil, nil, errors.New("nts: authenticator too short")
+	}
+
+	nonce = clone(value[4 : 4+nonceLen])
+	ciphertext = clone(value[4+paddedNonceLen : 4+paddedNonceLen+ciphertextLen])
+	return nonce, ciphertext, nil
+}
+
+// pad4 rounds n up to the nearest multiple of 4.
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
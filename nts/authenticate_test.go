@@ -0,0 +1,192 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package nts
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/OpenPSG/sntp/types"
+)
+
+// newProtectedRequest builds a client request carrying a cookie for c2s/s2c
+// and an Authenticator extension field sealed with c2s, as a real NTS client
+// would.
+func newProtectedRequest(t *testing.T, store *MasterKeyStore, c2s, s2c []byte) types.Packet {
+	t.Helper()
+
+	cookie, err := store.EncodeCookie(c2s, s2c)
+	require.NoError(t, err)
+
+	req := types.Packet{}
+	req.SetMode(types.ModeClient)
+	req.SetVersion(types.Version4)
+	req.Extensions = []types.ExtensionField{
+		{Type: types.ExtensionFieldTypeUniqueIdentifier, Value: []byte{0x01, 0x02, 0x03, 0x04}},
+		{Type: types.ExtensionFieldTypeNTSCookie, Value: cookie},
+	}
+
+	prefix, err := authenticatedPrefix(&req)
+	require.NoError(t, err)
+
+	authValue, err := sealAuthenticator(c2s, nil, prefix)
+	require.NoError(t, err)
+
+	req.Extensions = append(req.Extensions, types.ExtensionField{
+		Type:  types.ExtensionFieldTypeNTSAuthenticator,
+		Value: authValue,
+	})
+
+	return req
+}
+
+func TestProtect(t *testing.T) {
+	store, err := NewMasterKeyStore(1)
+	require.NoError(t, err)
+
+	c2s := make([]byte, cookieKeySize)
+	s2c := make([]byte, cookieKeySize)
+	_, err = rand.Read(c2s)
+	require.NoError(t, err)
+	_, err = rand.Read(s2c)
+	require.NoError(t, err)
+
+	req := newProtectedRequest(t, store, c2s, s2c)
+
+	resp := types.Packet{}
+	resp.SetMode(types.ModeServer)
+	resp.SetVersion(types.Version4)
+
+	require.NoError(t, Protect(store, &resp, &req))
+
+	// The response should echo the client's Unique Identifier.
+	uid, ok := resp.Extension(types.ExtensionFieldTypeUniqueIdentifier)
+	require.True(t, ok)
+	require.Equal(t, []byte{0x01, 0x02, 0x03, 0x04}, uid.Value)
+
+	// The response's authenticator should open with the S2C key, and reveal
+	// a fresh cookie encrypting the same C2S/S2C keys.
+	authEF, ok := resp.Extension(types.ExtensionFieldTypeNTSAuthenticator)
+	require.True(t, ok)
+
+	prefix, err := authenticatedPrefix(&resp)
+	require.NoError(t, err)
+
+	plaintext, err := openAuthenticator(s2c, authEF.Value, prefix)
+	require.NoError(t, err)
+
+	encrypted, err := types.UnmarshalExtensionFields(plaintext)
+	require.NoError(t, err)
+	require.Len(t, encrypted, 1)
+	require.Equal(t, types.ExtensionFieldTypeNTSCookie, encrypted[0].Type)
+
+	gotC2S, gotS2C, err := store.DecodeCookie(encrypted[0].Value)
+	require.NoError(t, err)
+	require.Equal(t, c2s, gotC2S)
+	require.Equal(t, s2c, gotS2C)
+}
+
+func TestProtectMintsACookiePerPlaceholder(t *testing.T) {
+	store, err := NewMasterKeyStore(1)
+	require.NoError(t, err)
+
+	c2s := make([]byte, cookieKeySize)
+	s2c := make([]byte, cookieKeySize)
+
+	req := newProtectedRequest(t, store, c2s, s2c)
+	// Insert two placeholders before the authenticator field, which must
+	// stay last.
+	authEF := req.Extensions[len(req.Extensions)-1]
+	req.Extensions = append(req.Extensions[:len(req.Extensions)-1],
+		types.ExtensionField{Type: types.ExtensionFieldTypeNTSCookiePlaceholder, Value: make([]byte, len(authEF.Value))},
+		types.ExtensionField{Type: types.ExtensionFieldTypeNTSCookiePlaceholder, Value: make([]byte, len(authEF.Value))},
+	)
+
+	// Re-seal the authenticator now that the placeholders are part of the
+	// authenticated prefix.
+	prefix, err := authenticatedPrefix(&req)
+	require.NoError(t, err)
+	authValue, err := sealAuthenticator(c2s, nil, prefix)
+	require.NoError(t, err)
+	req.Extensions = append(req.Extensions, types.ExtensionField{
+		Type:  types.ExtensionFieldTypeNTSAuthenticator,
+		Value: authValue,
+	})
+
+	resp := types.Packet{}
+	resp.SetMode(types.ModeServer)
+	resp.SetVersion(types.Version4)
+
+	require.NoError(t, Protect(store, &resp, &req))
+
+	authRespEF, ok := resp.Extension(types.ExtensionFieldTypeNTSAuthenticator)
+	require.True(t, ok)
+
+	respPrefix, err := authenticatedPrefix(&resp)
+	require.NoError(t, err)
+
+	plaintext, err := openAuthenticator(s2c, authRespEF.Value, respPrefix)
+	require.NoError(t, err)
+
+	encrypted, err := types.UnmarshalExtensionFields(plaintext)
+	require.NoError(t, err)
+	// One cookie to replace the one spent, plus one per placeholder.
+	require.Len(t, encrypted, 3)
+}
+
+func TestProtectRejectsMissingCookie(t *testing.T) {
+	store, err := NewMasterKeyStore(1)
+	require.NoError(t, err)
+
+	req := types.Packet{}
+	req.SetMode(types.ModeClient)
+	req.SetVersion(types.Version4)
+
+	var resp types.Packet
+	err = Protect(store, &resp, &req)
+	require.ErrorIs(t, err, ErrUnauthenticated)
+}
+
+func TestProtectRejectsBadAuthenticator(t *testing.T) {
+	store, err := NewMasterKeyStore(1)
+	require.NoError(t, err)
+
+	c2s := make([]byte, cookieKeySize)
+	s2c := make([]byte, cookieKeySize)
+
+	req := newProtectedRequest(t, store, c2s, s2c)
+
+	// Corrupt the authenticator.
+	authIdx := len(req.Extensions) - 1
+	req.Extensions[authIdx].Value[0] ^= 0xFF
+
+	var resp types.Packet
+	err = Protect(store, &resp, &req)
+	require.ErrorIs(t, err, ErrUnauthenticated)
+}
+
+func TestProtectRejectsUnknownCookieKey(t *testing.T) {
+	store, err := NewMasterKeyStore(0)
+	require.NoError(t, err)
+
+	c2s := make([]byte, cookieKeySize)
+	s2c := make([]byte, cookieKeySize)
+
+	req := newProtectedRequest(t, store, c2s, s2c)
+
+	// Rotate past the key the cookie was encrypted under, with no retention.
+	require.NoError(t, store.Rotate())
+
+	var resp types.Packet
+	err = Protect(store, &resp, &req)
+	require.ErrorIs(t, err, ErrUnknownCookieKey)
+}
@@ -0,0 +1,191 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+// Package nts implements server-side Network Time Security (RFC 8915): the
+// NTS-KE handshake that hands clients cookies and keys, and the per-request
+// verification and re-cookying of NTS-protected NTP packets.
+package nts
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	siv "github.com/secure-io/siv-go"
+)
+
+// cookieKeySize is the key size required by AEAD_AES_SIV_CMAC_256 (RFC 8915
+// §5.6), the only AEAD algorithm this package implements.
+const cookieKeySize = 32
+
+// ErrUnknownCookieKey is returned when a cookie was encrypted under a master
+// key the store no longer retains, e.g. because it has since rotated out.
+// The caller should treat this the same as an invalid cookie: reject the
+// request and let the client fetch a fresh one over NTS-KE.
+var ErrUnknownCookieKey = errors.New("nts: cookie encrypted under unknown master key")
+
+// masterKey is one generation of the symmetric key used to encrypt cookies.
+type masterKey struct {
+	id  uint32
+	key []byte
+}
+
+// MasterKeyStore holds the rotating set of master keys used to encrypt and
+// decrypt NTS cookies. A Server's NTS-KE listener and the sntp.Server it
+// feeds cookies to must share a single MasterKeyStore, since one mints
+// cookies and the other has to be able to open them.
+type MasterKeyStore struct {
+	mu     sync.RWMutex
+	keys   []masterKey // keys[len(keys)-1] is the current key.
+	nextID uint32
+	retain int
+}
+
+// NewMasterKeyStore creates a MasterKeyStore with a freshly generated master
+// key. After each Rotate, up to retain previous keys are kept around so
+// cookies minted before the rotation remain valid until they age out.
+func NewMasterKeyStore(retain int) (*MasterKeyStore, error) {
+	s := &MasterKeyStore{retain: retain}
+	if err := s.Rotate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Rotate generates a new master key and makes it current.
+func (s *MasterKeyStore) Rotate() error {
+	key := make([]byte, cookieKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("nts: error generating master key: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys = append(s.keys, masterKey{id: s.nextID, key: key})
+	s.nextID++
+	if len(s.keys) > s.retain+1 {
+		s.keys = s.keys[len(s.keys)-(s.retain+1):]
+	}
+
+	return nil
+}
+
+// Run rotates the master key every interval, until ctx is canceled.
+func (s *MasterKeyStore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Rotate(); err != nil {
+				slog.Error("Error rotating NTS master key", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+func (s *MasterKeyStore) current() masterKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys[len(s.keys)-1]
+}
+
+func (s *MasterKeyStore) find(id uint32) (masterKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, k := range s.keys {
+		if k.id == id {
+			return k, true
+		}
+	}
+	return masterKey{}, false
+}
+
+// EncodeCookie encrypts c2s and s2c, the client-to-server and
+// server-to-client keys negotiated for an NTS association, into an opaque
+// cookie under the store's current master key.
+func (s *MasterKeyStore) EncodeCookie(c2s, s2c []byte) ([]byte, error) {
+	mk := s.current()
+
+	aead, err := siv.NewCMAC(mk.key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("nts: error generating cookie nonce: %w", err)
+	}
+
+	plaintext := make([]byte, len(c2s)+len(s2c))
+	copy(plaintext, c2s)
+	copy(plaintext[len(c2s):], s2c)
+	ciphertext := aead.Seal(nil, nonce, plaintext, nil)
+
+	cookie := make([]byte, 4+len(nonce)+len(ciphertext))
+	binary.BigEndian.PutUint32(cookie[:4], mk.id)
+	copy(cookie[4:], nonce)
+	copy(cookie[4+len(nonce):], ciphertext)
+
+	return cookie, nil
+}
+
+// DecodeCookie reverses EncodeCookie, returning the C2S and S2C keys it
+// encrypts. It returns ErrUnknownCookieKey if the cookie was encrypted under
+// a master key this store no longer retains.
+func (s *MasterKeyStore) DecodeCookie(cookie []byte) (c2s, s2c []byte, err error) {
+	if len(cookie) < 4 {
+		return nil, nil, errors.New("nts: cookie too short")
+	}
+
+	id := binary.BigEndian.Uint32(cookie[:4])
+	mk, ok := s.find(id)
+	if !ok {
+		return nil, nil, ErrUnknownCookieKey
+	}
+
+	aead, err := siv.NewCMAC(mk.key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(cookie) < 4+aead.NonceSize() {
+		return nil, nil, errors.New("nts: cookie too short")
+	}
+	// siv-go's AES-NI implementation misbehaves when given a nonce or
+	// ciphertext slice that has spare capacity (i.e. a sub-slice of a
+	// larger buffer), so clone both to an exact-sized allocation first.
+	nonce := clone(cookie[4 : 4+aead.NonceSize()])
+	ciphertext := clone(cookie[4+aead.NonceSize():])
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("nts: error decrypting cookie: %w", err)
+	}
+	if len(plaintext) != 2*cookieKeySize {
+		return nil, nil, errors.New("nts: malformed cookie plaintext")
+	}
+
+	return plaintext[:cookieKeySize], plaintext[cookieKeySize:], nil
+}
+
+// clone returns an exact-capacity copy of b.
+func clone(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
@@ -0,0 +1,69 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package nts
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMasterKeyStoreCookieRoundTrip(t *testing.T) {
+	store, err := NewMasterKeyStore(1)
+	require.NoError(t, err)
+
+	c2s := make([]byte, cookieKeySize)
+	s2c := make([]byte, cookieKeySize)
+	for i := range c2s {
+		c2s[i] = byte(i)
+		s2c[i] = byte(255 - i)
+	}
+
+	cookie, err := store.EncodeCookie(c2s, s2c)
+	require.NoError(t, err)
+
+	gotC2S, gotS2C, err := store.DecodeCookie(cookie)
+	require.NoError(t, err)
+	require.Equal(t, c2s, gotC2S)
+	require.Equal(t, s2c, gotS2C)
+}
+
+func TestMasterKeyStoreRotateRetainsPreviousKeys(t *testing.T) {
+	store, err := NewMasterKeyStore(1)
+	require.NoError(t, err)
+
+	c2s := make([]byte, cookieKeySize)
+	s2c := make([]byte, cookieKeySize)
+
+	cookie, err := store.EncodeCookie(c2s, s2c)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Rotate())
+
+	// A cookie minted under the previous key should still decode, since
+	// retain=1 keeps one generation around.
+	_, _, err = store.DecodeCookie(cookie)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Rotate())
+
+	// Now two rotations have happened since the cookie was minted, so its
+	// key should have aged out.
+	_, _, err = store.DecodeCookie(cookie)
+	require.ErrorIs(t, err, ErrUnknownCookieKey)
+}
+
+func TestMasterKeyStoreDecodeCookieRejectsGarbage(t *testing.T) {
+	store, err := NewMasterKeyStore(1)
+	require.NoError(t, err)
+
+	_, _, err = store.DecodeCookie([]byte{0x01, 0x02})
+	require.Error(t, err)
+}
@@ -0,0 +1,316 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package nts
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ALPNProtocol is the ALPN protocol identifier NTS-KE negotiates over TLS,
+// per RFC 8915 §3.
+const ALPNProtocol = "ntske/1"
+
+// recordType identifies the kind of body carried by an NTS-KE record, per
+// RFC 8915 §4. The top bit is the "Critical" flag; this package always sets
+// it on records a client must understand to proceed.
+type recordType uint16
+
+const (
+	recordTypeEndOfMessage             recordType = 0
+	recordTypeNextProtocolNegotiation  recordType = 1
+	recordTypeError                    recordType = 2
+	recordTypeWarning                  recordType = 3
+	recordTypeAEADAlgorithmNegotiation recordType = 4
+	recordTypeNewCookie                recordType = 5
+	recordTypeNTPv4ServerNegotiation   recordType = 6
+	recordTypeNTPv4PortNegotiation     recordType = 7
+
+	criticalBit recordType = 1 << 15
+)
+
+const (
+	// nextProtocolNTPv4 is the "NTS Next Protocol Negotiation" value for
+	// NTPv4, the only protocol this package implements.
+	nextProtocolNTPv4 = 0
+	// aeadAESSIVCMAC256 is the IANA AEAD algorithm ID for
+	// AEAD_AES_SIV_CMAC_256, the only algorithm this package implements.
+	aeadAESSIVCMAC256 = 15
+	// numCookies is the number of cookies handed to a client per NTS-KE
+	// exchange, so it can keep requesting time for a while without reusing
+	// one.
+	numCookies = 8
+	// exporterLabel is the TLS exporter label used to derive NTS C2S/S2C
+	// keys, per RFC 8915 §5.1.
+	exporterLabel = "EXPORTER-network-time-security"
+
+	// requestTimeout bounds how long handleConn will wait for a client to
+	// finish sending its NTS-KE request after the TLS handshake completes,
+	// so a client that trickles or withholds data can't pin a goroutine
+	// indefinitely.
+	requestTimeout = 5 * time.Second
+	// maxRequestRecords bounds the number of records readRecords will
+	// accept before giving up, so a client that never sends an End of
+	// Message record can't grow memory unboundedly.
+	maxRequestRecords = 32
+	// maxRequestBytes bounds the total record bytes (headers and bodies)
+	// readRecords will accept before giving up, for the same reason.
+	maxRequestBytes = 4096
+)
+
+// party distinguishes the client-to-server and server-to-client halves of an
+// NTS key pair in the TLS exporter context, per RFC 8915 §5.1.
+type party byte
+
+const (
+	partyC2S party = 0x00
+	partyS2C party = 0x01
+)
+
+// KEServer negotiates NTS associations over TLS, handing out cookies that an
+// sntp.Server configured with the same MasterKeyStore (via sntp.WithNTS)
+// will recognize.
+type KEServer struct {
+	keys      *MasterKeyStore
+	tlsConfig *tls.Config
+
+	// NTPAddr, if set, is advertised to clients as the NTPv4 server and port
+	// they should use, per RFC 8915 §4.1.6-4.1.7. If empty, clients assume
+	// the NTS-KE server's own host and the standard NTP port.
+	NTPAddr string
+}
+
+// NewKEServer returns a KEServer that encrypts cookies with keys and
+// negotiates TLS using tlsConfig, which must already be configured with a
+// certificate. tlsConfig is cloned, and the clone's NextProtos is
+// overwritten to advertise ALPNProtocol.
+func NewKEServer(keys *MasterKeyStore, tlsConfig *tls.Config) *KEServer {
+	cfg := tlsConfig.Clone()
+	cfg.NextProtos = []string{ALPNProtocol}
+	return &KEServer{keys: keys, tlsConfig: cfg}
+}
+
+// ListenAndServe accepts NTS-KE connections on addr until ctx is canceled.
+func (s *KEServer) ListenAndServe(ctx context.Context, addr string) error {
+	ln, err := tls.Listen("tcp", addr, s.tlsConfig)
+	if err != nil {
+		return fmt.Errorf("error listening on TCP: %w", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+				return fmt.Errorf("error accepting connection: %w", err)
+			}
+		}
+
+		go s.handleConn(conn.(*tls.Conn))
+	}
+}
+
+func (s *KEServer) handleConn(conn *tls.Conn) {
+	defer conn.Close()
+
+	if err := conn.Handshake(); err != nil {
+		slog.Warn("NTS-KE TLS handshake failed", slog.Any("error", err))
+		return
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
+		slog.Warn("Error setting NTS-KE connection deadline", slog.Any("error", err))
+		return
+	}
+
+	records, err := readRecords(conn)
+	if err != nil {
+		slog.Warn("Error reading NTS-KE request", slog.Any("error", err))
+		return
+	}
+
+	if err := validateRequest(records); err != nil {
+		slog.Warn("Rejecting NTS-KE request", slog.Any("error", err))
+		_ = writeRecords(conn, []record{errorRecord(1), {typ: recordTypeEndOfMessage | criticalBit}})
+		return
+	}
+
+	c2s, err := s.exportKey(conn, partyC2S)
+	if err != nil {
+		slog.Error("Error deriving NTS C2S key", slog.Any("error", err))
+		return
+	}
+
+	s2c, err := s.exportKey(conn, partyS2C)
+	if err != nil {
+		slog.Error("Error deriving NTS S2C key", slog.Any("error", err))
+		return
+	}
+
+	resp := []record{
+		{typ: recordTypeNextProtocolNegotiation | criticalBit, body: uint16Body(nextProtocolNTPv4)},
+		{typ: recordTypeAEADAlgorithmNegotiation, body: uint16Body(aeadAESSIVCMAC256)},
+	}
+
+	for i := 0; i < numCookies; i++ {
+		cookie, err := s.keys.EncodeCookie(c2s, s2c)
+		if err != nil {
+			slog.Error("Error encoding NTS cookie", slog.Any("error", err))
+			return
+		}
+		resp = append(resp, record{typ: recordTypeNewCookie, body: cookie})
+	}
+
+	if s.NTPAddr != "" {
+		if host, port, err := net.SplitHostPort(s.NTPAddr); err == nil {
+			if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+				resp = append(resp, record{typ: recordTypeNTPv4ServerNegotiation, body: []byte(host)})
+				resp = append(resp, record{typ: recordTypeNTPv4PortNegotiation, body: uint16Body(uint16(p))})
+			}
+		}
+	}
+
+	resp = append(resp, record{typ: recordTypeEndOfMessage | criticalBit})
+
+	if err := writeRecords(conn, resp); err != nil {
+		slog.Warn("Error writing NTS-KE response", slog.Any("error", err))
+	}
+}
+
+// exportKey derives the C2S or S2C key for the TLS session underlying conn,
+// per RFC 8915 §5.1. The context is the negotiated protocol and AEAD
+// algorithm IDs followed by the party determinator, so that a client and
+// server negotiating different parameters never derive the same key.
+func (s *KEServer) exportKey(conn *tls.Conn, p party) ([]byte, error) {
+	context := make([]byte, 5)
+	binary.BigEndian.PutUint16(context[0:2], nextProtocolNTPv4)
+	binary.BigEndian.PutUint16(context[2:4], aeadAESSIVCMAC256)
+	context[4] = byte(p)
+
+	state := conn.ConnectionState()
+	return state.ExportKeyingMaterial(exporterLabel, context, cookieKeySize)
+}
+
+// record is a single RFC 8915 §4 NTS-KE record.
+type record struct {
+	typ  recordType
+	body []byte
+}
+
+// MarshalBinary encodes the record as its 4-byte Type/Length header followed
+// by its body.
+func (r record) MarshalBinary() []byte {
+	buf := make([]byte, 4+len(r.body))
+	binary.BigEndian.PutUint16(buf[0:2], uint16(r.typ))
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(r.body)))
+	copy(buf[4:], r.body)
+	return buf
+}
+
+func writeRecords(w io.Writer, records []record) error {
+	for _, r := range records {
+		if _, err := w.Write(r.MarshalBinary()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRecords reads records from r until an End of Message record is seen,
+// rejecting requests that exceed maxRequestRecords or maxRequestBytes.
+func readRecords(r io.Reader) ([]record, error) {
+	var records []record
+	var totalBytes int
+	for {
+		if len(records) >= maxRequestRecords {
+			return nil, fmt.Errorf("nts-ke: request exceeds %d records", maxRequestRecords)
+		}
+
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+
+		typ := recordType(binary.BigEndian.Uint16(header[0:2])) &^ criticalBit
+		length := binary.BigEndian.Uint16(header[2:4])
+
+		totalBytes += len(header) + int(length)
+		if totalBytes > maxRequestBytes {
+			return nil, fmt.Errorf("nts-ke: request exceeds %d bytes", maxRequestBytes)
+		}
+
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, err
+		}
+
+		records = append(records, record{typ: typ, body: body})
+
+		if typ == recordTypeEndOfMessage {
+			return records, nil
+		}
+	}
+}
+
+// validateRequest checks that records include the records a client must
+// send to start an NTS-KE exchange for NTPv4 over AEAD_AES_SIV_CMAC_256.
+func validateRequest(records []record) error {
+	var sawProtocol, sawAlgorithm bool
+	for _, r := range records {
+		switch r.typ {
+		case recordTypeNextProtocolNegotiation:
+			if len(r.body) != 2 || binary.BigEndian.Uint16(r.body) != nextProtocolNTPv4 {
+				return errors.New("nts-ke: client does not support NTPv4")
+			}
+			sawProtocol = true
+		case recordTypeAEADAlgorithmNegotiation:
+			for i := 0; i+1 < len(r.body); i += 2 {
+				if binary.BigEndian.Uint16(r.body[i:]) == aeadAESSIVCMAC256 {
+					sawAlgorithm = true
+				}
+			}
+		}
+	}
+
+	if !sawProtocol {
+		return errors.New("nts-ke: missing NTS Next Protocol Negotiation record")
+	}
+	if !sawAlgorithm {
+		return errors.New("nts-ke: client does not support AEAD_AES_SIV_CMAC_256")
+	}
+
+	return nil
+}
+
+func uint16Body(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func errorRecord(code uint16) record {
+	return record{typ: recordTypeError | criticalBit, body: uint16Body(code)}
+}
@@ -0,0 +1,172 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package nts
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// generateTestCertificate returns a self-signed certificate for localhost,
+// suitable for a tls.Config used only in tests.
+func generateTestCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}
+}
+
+func TestKEServer(t *testing.T) {
+	cert := generateTestCertificate(t)
+	store, err := NewMasterKeyStore(1)
+	require.NoError(t, err)
+
+	srv := NewKEServer(store, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go func() {
+		_ = srv.ListenAndServe(ctx, "localhost:4460")
+	}()
+
+	// Wait for the server to start.
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := tls.Dial("tcp", "localhost:4460", &tls.Config{
+		InsecureSkipVerify: true, //nolint:gosec // test-only self-signed cert.
+		NextProtos:         []string{ALPNProtocol},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	req := []record{
+		{typ: recordTypeNextProtocolNegotiation | criticalBit, body: uint16Body(nextProtocolNTPv4)},
+		{typ: recordTypeAEADAlgorithmNegotiation, body: uint16Body(aeadAESSIVCMAC256)},
+		{typ: recordTypeEndOfMessage | criticalBit},
+	}
+	require.NoError(t, writeRecords(conn, req))
+
+	resp, err := readRecords(conn)
+	require.NoError(t, err)
+
+	var cookies int
+	var sawProtocol, sawAlgorithm bool
+	for _, r := range resp {
+		switch r.typ {
+		case recordTypeNextProtocolNegotiation:
+			require.Equal(t, uint16(nextProtocolNTPv4), binary.BigEndian.Uint16(r.body))
+			sawProtocol = true
+		case recordTypeAEADAlgorithmNegotiation:
+			require.Equal(t, uint16(aeadAESSIVCMAC256), binary.BigEndian.Uint16(r.body))
+			sawAlgorithm = true
+		case recordTypeNewCookie:
+			cookies++
+		}
+	}
+
+	require.True(t, sawProtocol)
+	require.True(t, sawAlgorithm)
+	require.Equal(t, numCookies, cookies)
+}
+
+func TestKEServerRejectsUnsupportedAlgorithm(t *testing.T) {
+	cert := generateTestCertificate(t)
+	store, err := NewMasterKeyStore(1)
+	require.NoError(t, err)
+
+	srv := NewKEServer(store, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go func() {
+		_ = srv.ListenAndServe(ctx, "localhost:4461")
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := tls.Dial("tcp", "localhost:4461", &tls.Config{
+		InsecureSkipVerify: true, //nolint:gosec // test-only self-signed cert.
+		NextProtos:         []string{ALPNProtocol},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	req := []record{
+		{typ: recordTypeNextProtocolNegotiation | criticalBit, body: uint16Body(nextProtocolNTPv4)},
+		{typ: recordTypeEndOfMessage | criticalBit},
+	}
+	require.NoError(t, writeRecords(conn, req))
+
+	resp, err := readRecords(conn)
+	require.NoError(t, err)
+	require.Len(t, resp, 2)
+	require.Equal(t, recordTypeError, resp[0].typ&^criticalBit)
+}
+
+func TestReadRecordsRejectsTooManyRecords(t *testing.T) {
+	var buf bytes.Buffer
+	records := make([]record, maxRequestRecords+1)
+	for i := range records {
+		records[i] = record{typ: recordTypeWarning}
+	}
+	require.NoError(t, writeRecords(&buf, records))
+
+	_, err := readRecords(&buf)
+	require.Error(t, err)
+}
+
+func TestReadRecordsRejectsTooManyBytes(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeRecords(&buf, []record{
+		{typ: recordTypeWarning, body: make([]byte, maxRequestBytes)},
+	}))
+
+	_, err := readRecords(&buf)
+	require.Error(t, err)
+}
+
+func TestReadRecordsStopsAtEndOfMessage(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeRecords(&buf, []record{
+		{typ: recordTypeNextProtocolNegotiation, body: uint16Body(nextProtocolNTPv4)},
+		{typ: recordTypeEndOfMessage | criticalBit},
+	}))
+
+	records, err := readRecords(&buf)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+}
@@ -10,21 +10,24 @@
 package sntp
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math"
 	"math/big"
 	"net"
 	"net/netip"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/golang-lru/v2/expirable"
 	"golang.org/x/time/rate"
 
+	"github.com/OpenPSG/sntp/auth"
+	"github.com/OpenPSG/sntp/metrics"
+	"github.com/OpenPSG/sntp/nts"
 	"github.com/OpenPSG/sntp/types"
 )
 
@@ -33,16 +36,38 @@ const (
 	maxRateLimiters = 10000
 	// The minimum interval between requests from a single client.
 	minInterval = 10 * time.Second
+	// The largest datagram we'll accept, large enough for an RFC 4330
+	// header plus a full set of NTS extension fields.
+	maxPacketSize = 2048
 )
 
 type Server struct {
 	rateLimiters *expirable.LRU[netip.Addr, *rate.Limiter]
+
+	upstreamPool         []string
+	upstreamInterval     time.Duration
+	fallbackToLocalClock bool
+
+	upstreamMu sync.RWMutex
+	upstream   upstreamState
+
+	recorder metrics.Recorder
+
+	ntsKeys  *nts.MasterKeyStore
+	keyStore *auth.KeyStore
 }
 
-func NewServer() *Server {
-	return &Server{
+func NewServer(opts ...Option) *Server {
+	s := &Server{
 		rateLimiters: expirable.NewLRU[netip.Addr, *rate.Limiter](maxRateLimiters, nil, 24*time.Hour),
+		recorder:     metrics.NoOp{},
+	}
+
+	for _, opt := range opts {
+		opt(s)
 	}
+
+	return s
 }
 
 func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
@@ -57,6 +82,10 @@ func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
 	}
 	defer conn.Close()
 
+	if len(s.upstreamPool) > 0 {
+		go s.syncUpstream(ctx)
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -64,23 +93,27 @@ func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
 		default:
 		}
 
-		req := make([]byte, binary.Size(types.Packet{}))
+		req := make([]byte, maxPacketSize)
 		n, addr, err := conn.ReadFromUDP(req)
 		recvTimestamp := time.Now()
 		if err != nil {
 			return fmt.Errorf("error reading from UDP: %w", err)
 		}
 
-		// Is the packet the correct size?
-		if n < len(req) {
+		s.recorder.RequestReceived()
+
+		// Is the packet at least large enough to hold a header?
+		if n < types.PacketHeaderSize {
 			slog.Warn("Received undersized packet", slog.Int("size", n))
+			s.recorder.MalformedPacket()
 			continue
 		}
 
 		// Is the client rate limited?
 		if !s.checkRateLimit(addr) {
 			slog.Warn("Rate limited client", slog.String("addr", addr.String()))
-			// TODO: Send a kiss of death packet indicating the client is rate limited.
+			s.recorder.RateLimited()
+			s.sendKissOfDeath(conn, addr, req[:n], types.KissOfDeathCodeRateExceeded)
 			continue
 		}
 
@@ -90,46 +123,202 @@ func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
 
 func (s *Server) handleRequest(conn *net.UDPConn, addr *net.UDPAddr, req []byte, recvTimestamp time.Time) {
 	var clientRequest types.Packet
-	if err := binary.Read(bytes.NewReader(req), binary.BigEndian, &clientRequest); err != nil {
+	if err := clientRequest.UnmarshalBinary(req); err != nil {
 		slog.Error("Error decoding request", slog.Any("error", err))
+		s.recorder.MalformedPacket()
 		return
 	}
 
-	if clientRequest.GetMode() != types.ModeClient || clientRequest.GetVersion() != types.Version4 {
+	version := clientRequest.GetVersion()
+	if clientRequest.GetMode() != types.ModeClient || (version != types.Version3 && version != types.Version4) {
 		slog.Warn("Received invalid request", slog.Any("packet", clientRequest))
-		// TODO: Send a kiss of death packet indicating the client is using an invalid mode or version.
+		s.sendKissOfDeath(conn, addr, req, types.KissOfDeathCodeDeny)
 		return
 	}
 
-	serverResponse := types.Packet{
+	if clientRequest.MAC != nil {
+		if s.keyStore == nil {
+			s.sendKissOfDeath(conn, addr, req, types.KissOfDeathCodeNoKeyFound)
+			return
+		}
+
+		if err := s.keyStore.Verify(clientRequest.MAC, req[:types.PacketHeaderSize]); err != nil {
+			slog.Warn("Rejecting request with invalid MAC", slog.Any("error", err))
+			code := types.KissOfDeathCodeCryptographic
+			if errors.Is(err, auth.ErrUnknownKey) {
+				code = types.KissOfDeathCodeNoKeyFound
+			}
+			s.sendKissOfDeath(conn, addr, req, code)
+			return
+		}
+	}
+
+	serverResponse := s.buildResponse(clientRequest, recvTimestamp)
+	serverResponse.Poll = clientRequest.Poll
+
+	serverResponse.SetMode(types.ModeServer)
+	serverResponse.SetVersion(version)
+
+	// Populate the transmit timestamp as late as possible, since an
+	// NTS-protected response's authenticator must cover the final header.
+	xmitTimestamp := time.Now()
+	serverResponse.XmitTimestamp = toNTPTime(xmitTimestamp.Add(s.clockOffset()))
+
+	if _, ok := clientRequest.Extension(types.ExtensionFieldTypeNTSCookie); s.ntsKeys != nil && ok {
+		if err := nts.Protect(s.ntsKeys, &serverResponse, &clientRequest); err != nil {
+			slog.Warn("Rejecting NTS-protected request", slog.Any("error", err))
+			code := types.KissOfDeathCodeAuthentication
+			if errors.Is(err, nts.ErrUnknownCookieKey) {
+				code = types.KissOfDeathCodeNoKeyFound
+			}
+			s.sendKissOfDeath(conn, addr, req, code)
+			return
+		}
+	}
+
+	if clientRequest.MAC != nil {
+		header, err := serverResponse.MarshalBinary()
+		if err != nil {
+			slog.Error("Error encoding response", slog.Any("error", err))
+			return
+		}
+
+		mac, err := s.keyStore.Sign(clientRequest.MAC.KeyID, header[:types.PacketHeaderSize])
+		if err != nil {
+			slog.Error("Error signing response", slog.Any("error", err))
+			return
+		}
+		serverResponse.MAC = mac
+	}
+
+	respBytes, err := serverResponse.MarshalBinary()
+	if err != nil {
+		slog.Error("Error encoding response", slog.Any("error", err))
+		return
+	}
+
+	// Send the response.
+	if _, err := conn.WriteToUDP(respBytes, addr); err != nil {
+		slog.Error("Error sending response", slog.Any("error", err))
+		return
+	}
+
+	// An unsynchronized response is itself a Kiss-of-Death.
+	if serverResponse.Stratum == types.StratumUnspecified {
+		s.recorder.KissOfDeathSent(string(types.KissOfDeathCodeNotSynchronized))
+		return
+	}
+
+	s.recorder.RequestServed(uint8(serverResponse.Stratum), fromNTPShort(serverResponse.RootDelay),
+		fromNTPShort(serverResponse.RootDispersion), xmitTimestamp.Sub(recvTimestamp))
+}
+
+// buildResponse constructs the outgoing packet for a validated client
+// request. If the server was configured with WithUpstream, it advertises
+// time disciplined against the most recently synchronized upstream server;
+// otherwise it falls back to advertising the local clock as a stratum 1
+// source.
+func (s *Server) buildResponse(clientRequest types.Packet, recvTimestamp time.Time) types.Packet {
+	if len(s.upstreamPool) == 0 {
+		return s.localClockResponse(clientRequest, recvTimestamp)
+	}
+
+	upstream := s.upstreamSnapshot()
+	if !upstream.synced {
+		if s.fallbackToLocalClock {
+			return s.localClockResponse(clientRequest, recvTimestamp)
+		}
+
+		// We have never successfully synchronized with an upstream server,
+		// so we can't honestly vouch for our clock.
+		unsyncedResponse := types.Packet{
+			OrigTimestamp: clientRequest.XmitTimestamp,
+			RecvTimestamp: toNTPTime(recvTimestamp),
+		}
+		unsyncedResponse.SetLeapIndicator(types.LeapIndicatorAlarmCondition)
+		unsyncedResponse.SetKissOfDeath(types.KissOfDeathCodeNotSynchronized)
+		return unsyncedResponse
+	}
+
+	stratum := upstream.stratum + 1
+	if upstream.stratum >= types.StratumUnsynchronized {
+		stratum = types.StratumUnsynchronized
+	}
+
+	// Dispersion grows over time since the last successful sync, per the
+	// PHI clock frequency tolerance in RFC 5905 §10.
+	dispersionGrowth := time.Duration(float64(time.Since(upstream.lastSync)) * clockDispersionRate)
+
+	return types.Packet{
+		Stratum:        stratum,
+		Precision:      types.PrecisionOneMicrosecond,
+		RootDelay:      toNTPShort(upstream.rootDelay),
+		RootDispersion: toNTPShort(upstream.rootDispersion + absDuration(upstream.offset) + dispersionGrowth),
+		ReferenceID:    upstream.referenceID,
+		RefTimestamp:   toNTPTime(upstream.refTimestamp),
+		OrigTimestamp:  clientRequest.XmitTimestamp,
+		RecvTimestamp:  toNTPTime(recvTimestamp.Add(upstream.offset)),
+	}
+}
+
+// localClockResponse builds a response advertising the server's local clock
+// as a stratum 1 source, as if it had an uncalibrated local reference clock.
+func (s *Server) localClockResponse(clientRequest types.Packet, recvTimestamp time.Time) types.Packet {
+	resp := types.Packet{
 		Stratum:       types.StratumPrimary,
-		Poll:          clientRequest.Poll,
 		Precision:     types.PrecisionOneMicrosecond,
-		RefTimestamp:  toNTPTime(time.Now()), // TODO: Use a more accurate reference time.
+		RefTimestamp:  toNTPTime(time.Now()),
 		OrigTimestamp: clientRequest.XmitTimestamp,
 		RecvTimestamp: toNTPTime(recvTimestamp),
 	}
+	resp.SetExternalReferenceSource(types.ExternalReferenceSourceLocal)
+	return resp
+}
 
-	serverResponse.SetMode(types.ModeServer)
-	serverResponse.SetVersion(types.Version4)
-	serverResponse.SetExternalReferenceSource(types.ExternalReferenceSourceLocal)
+// clockOffset returns the current estimated offset between the local clock
+// and the synchronized upstream server, or zero if no upstream is
+// configured.
+func (s *Server) clockOffset() time.Duration {
+	if len(s.upstreamPool) == 0 {
+		return 0
+	}
+	return s.upstreamSnapshot().offset
+}
 
-	var resp bytes.Buffer
-	if err := binary.Write(&resp, binary.BigEndian, serverResponse); err != nil {
-		slog.Error("Error encoding response", slog.Any("error", err))
+// sendKissOfDeath replies to req with a Kiss-of-Death packet carrying code,
+// per RFC 5905 §7.4. The OrigTimestamp is copied from the client's
+// XmitTimestamp so the client can match the response to its request.
+func (s *Server) sendKissOfDeath(conn *net.UDPConn, addr *net.UDPAddr, req []byte, code types.KissOfDeathCode) {
+	var clientRequest types.Packet
+	if err := clientRequest.UnmarshalBinary(req); err != nil {
+		// RFC 5905 specifies that a server should send nothing in response
+		// to a packet it can't decode.
 		return
 	}
 
-	respBytes := resp.Bytes()
+	kodResponse := types.Packet{
+		Stratum:       types.StratumUnspecified,
+		Poll:          types.PollIntervalMaximum,
+		OrigTimestamp: clientRequest.XmitTimestamp,
+	}
 
-	// Populate the transmit timestamp at the last possible moment.
-	binary.BigEndian.PutUint64(respBytes[40:], toNTPTime(time.Now()))
+	kodResponse.SetLeapIndicator(types.LeapIndicatorAlarmCondition)
+	kodResponse.SetMode(types.ModeServer)
+	kodResponse.SetVersion(clientRequest.GetVersion())
+	kodResponse.SetKissOfDeath(code)
+
+	respBytes, err := kodResponse.MarshalBinary()
+	if err != nil {
+		slog.Error("Error encoding kiss of death response", slog.Any("error", err))
+		return
+	}
 
-	// Send the response.
 	if _, err := conn.WriteToUDP(respBytes, addr); err != nil {
-		slog.Error("Error sending response", slog.Any("error", err))
+		slog.Error("Error sending kiss of death response", slog.Any("error", err))
 		return
 	}
+
+	s.recorder.KissOfDeathSent(string(code))
 }
 
 func (s *Server) checkRateLimit(addr *net.UDPAddr) bool {
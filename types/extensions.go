@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package types
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ExtensionFieldType identifies the kind of data carried by an
+// ExtensionField, per the IANA "Network Time Security Extension Field
+// Types" registry.
+type ExtensionFieldType uint16
+
+const (
+	// Unique Identifier, RFC 8915 §5.3.
+	ExtensionFieldTypeUniqueIdentifier ExtensionFieldType = 0x0104
+	// NTS Cookie, RFC 8915 §5.4.
+	ExtensionFieldTypeNTSCookie ExtensionFieldType = 0x0204
+	// NTS Cookie Placeholder, RFC 8915 §5.5.
+	ExtensionFieldTypeNTSCookiePlaceholder ExtensionFieldType = 0x0304
+	// NTS Authenticator and Encrypted Extension Fields, RFC 8915 §5.6.
+	ExtensionFieldTypeNTSAuthenticator ExtensionFieldType = 0x0404
+)
+
+// ExtensionField is an RFC 7822 NTP extension field. Value must be a
+// multiple of 4 bytes; callers that need to carry data of another length
+// are responsible for padding it themselves.
+type ExtensionField struct {
+	Type  ExtensionFieldType
+	Value []byte
+}
+
+// MarshalExtensionFields encodes fields as a sequence of RFC 7822 TLVs, in
+// the same format used for the extension fields trailing a Packet.
+func MarshalExtensionFields(fields []ExtensionField) ([]byte, error) {
+	var buf []byte
+	for _, f := range fields {
+		if len(f.Value)%4 != 0 {
+			return nil, fmt.Errorf("extension field 0x%04x: value length must be a multiple of 4 bytes", f.Type)
+		}
+
+		length := 4 + len(f.Value)
+		if length > 0xFFFF {
+			return nil, fmt.Errorf("extension field 0x%04x: value too large", f.Type)
+		}
+
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint16(header[0:2], uint16(f.Type))
+		binary.BigEndian.PutUint16(header[2:4], uint16(length))
+
+		buf = append(buf, header...)
+		buf = append(buf, f.Value...)
+	}
+	return buf, nil
+}
+
+// UnmarshalExtensionFields decodes a sequence of RFC 7822 TLVs, in the same
+// format produced by MarshalExtensionFields.
+func UnmarshalExtensionFields(data []byte) ([]ExtensionField, error) {
+	var fields []ExtensionField
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated extension field header")
+		}
+
+		typ := ExtensionFieldType(binary.BigEndian.Uint16(data[0:2]))
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if length < 4 || length > len(data) {
+			return nil, fmt.Errorf("extension field 0x%04x: invalid length %d", typ, length)
+		}
+
+		value := make([]byte, length-4)
+		copy(value, data[4:length])
+
+		fields = append(fields, ExtensionField{Type: typ, Value: value})
+		data = data[length:]
+	}
+	return fields, nil
+}
+
+// Extension returns the first extension field of type typ, if any.
+func (p *Packet) Extension(typ ExtensionFieldType) (ExtensionField, bool) {
+	for _, f := range p.Extensions {
+		if f.Type == typ {
+			return f, true
+		}
+	}
+	return ExtensionField{}, false
+}
@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package types_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/OpenPSG/sntp/types"
+)
+
+func TestExtensionFieldsRoundTrip(t *testing.T) {
+	fields := []types.ExtensionField{
+		{Type: types.ExtensionFieldTypeUniqueIdentifier, Value: []byte{0x01, 0x02, 0x03, 0x04}},
+		{Type: types.ExtensionFieldTypeNTSCookie, Value: []byte{0xAA, 0xBB, 0xCC, 0xDD, 0xEE, 0xFF, 0x00, 0x11}},
+	}
+
+	encoded, err := types.MarshalExtensionFields(fields)
+	require.NoError(t, err)
+
+	decoded, err := types.UnmarshalExtensionFields(encoded)
+	require.NoError(t, err)
+
+	require.Equal(t, fields, decoded)
+}
+
+func TestMarshalExtensionFieldsRejectsUnpaddedValue(t *testing.T) {
+	_, err := types.MarshalExtensionFields([]types.ExtensionField{
+		{Type: types.ExtensionFieldTypeUniqueIdentifier, Value: []byte{0x01, 0x02, 0x03}},
+	})
+	require.Error(t, err)
+}
+
+func TestUnmarshalExtensionFieldsRejectsTruncatedData(t *testing.T) {
+	_, err := types.UnmarshalExtensionFields([]byte{0x01, 0x04, 0x00})
+	require.Error(t, err)
+}
+
+func TestPacketExtension(t *testing.T) {
+	p := types.Packet{
+		Extensions: []types.ExtensionField{
+			{Type: types.ExtensionFieldTypeNTSCookie, Value: []byte{0x01, 0x02, 0x03, 0x04}},
+		},
+	}
+
+	ef, ok := p.Extension(types.ExtensionFieldTypeNTSCookie)
+	require.True(t, ok)
+	require.Equal(t, []byte{0x01, 0x02, 0x03, 0x04}, ef.Value)
+
+	_, ok = p.Extension(types.ExtensionFieldTypeNTSAuthenticator)
+	require.False(t, ok)
+}
+
+func TestPacketBinaryRoundTrip(t *testing.T) {
+	p := types.Packet{
+		Stratum:       types.StratumPrimary,
+		Poll:          types.PollIntervalDefault,
+		Precision:     types.PrecisionOneMicrosecond,
+		XmitTimestamp: 0x1122334455667788,
+		Extensions: []types.ExtensionField{
+			{Type: types.ExtensionFieldTypeUniqueIdentifier, Value: []byte{0xDE, 0xAD, 0xBE, 0xEF}},
+		},
+	}
+	p.SetMode(types.ModeServer)
+	p.SetVersion(types.Version4)
+
+	encoded, err := p.MarshalBinary()
+	require.NoError(t, err)
+
+	var decoded types.Packet
+	require.NoError(t, decoded.UnmarshalBinary(encoded))
+
+	require.Equal(t, p, decoded)
+}
+
+func TestPacketUnmarshalBinaryRejectsShortPacket(t *testing.T) {
+	var p types.Packet
+	err := p.UnmarshalBinary(make([]byte, types.PacketHeaderSize-1))
+	require.Error(t, err)
+}
@@ -0,0 +1,19 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package types
+
+// MAC is the legacy RFC 1305 symmetric-key authenticator trailing an NTPv3
+// (or older NTPv4) packet: a key identifier followed by a keyed digest of
+// the packet header, computed under the secret that keyID refers to. The
+// digest is 16 bytes for MD5 or 20 bytes for SHA1.
+type MAC struct {
+	KeyID  uint32
+	Digest []byte
+}
@@ -0,0 +1,64 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package types_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/OpenPSG/sntp/types"
+)
+
+func TestPacketMACRoundTrip(t *testing.T) {
+	for _, digestSize := range []int{16, 20} {
+		p := types.Packet{
+			Stratum: types.StratumPrimary,
+			Poll:    types.PollIntervalDefault,
+			MAC: &types.MAC{
+				KeyID:  1,
+				Digest: make([]byte, digestSize),
+			},
+		}
+		p.SetMode(types.ModeClient)
+		p.SetVersion(types.Version3)
+		for i := range p.MAC.Digest {
+			p.MAC.Digest[i] = byte(i)
+		}
+
+		encoded, err := p.MarshalBinary()
+		require.NoError(t, err)
+
+		var decoded types.Packet
+		require.NoError(t, decoded.UnmarshalBinary(encoded))
+
+		require.Equal(t, p, decoded)
+		require.Nil(t, decoded.Extensions)
+	}
+}
+
+func TestPacketUnmarshalBinaryDecodesNonMACSizedTrailerAsExtensionFields(t *testing.T) {
+	// A trailer that isn't exactly 20 or 24 bytes long is decoded as
+	// extension fields, never as a MAC.
+	p := types.Packet{
+		Extensions: []types.ExtensionField{
+			{Type: types.ExtensionFieldTypeUniqueIdentifier, Value: []byte{0x01, 0x02, 0x03, 0x04}},
+		},
+	}
+
+	encoded, err := p.MarshalBinary()
+	require.NoError(t, err)
+
+	var decoded types.Packet
+	require.NoError(t, decoded.UnmarshalBinary(encoded))
+
+	require.Nil(t, decoded.MAC)
+	require.Equal(t, p.Extensions, decoded.Extensions)
+}
@@ -9,7 +9,11 @@
 
 package types
 
-import "encoding/binary"
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
 
 // LeapIndicator signifies whether a leap second will be added or subtracted at midnight.
 type LeapIndicator uint8
@@ -73,6 +77,8 @@ const (
 	StratumSecondary StratumLevel = 2
 	// Tertiary and beyond.
 	StratumTertiary StratumLevel = 3
+	// Unsynchronized: the clock is not synchronized to any reference.
+	StratumUnsynchronized StratumLevel = 16
 	// Reserved for future use or custom definitions.
 	StratumReserved StratumLevel = 255
 )
@@ -204,6 +210,123 @@ type Packet struct {
 	RecvTimestamp uint64
 	// Time at the server when the response left.
 	XmitTimestamp uint64
+	// RFC 7822 extension fields, e.g. for NTS (RFC 8915). Empty for a plain
+	// RFC 4330 packet. Mutually exclusive with MAC.
+	Extensions []ExtensionField
+	// MAC is the legacy RFC 1305 symmetric-key authenticator, used by NTPv3
+	// clients predating both RFC 7822 extension fields and NTS. Nil for an
+	// unauthenticated or NTS-protected packet. Mutually exclusive with
+	// Extensions.
+	MAC *MAC
+}
+
+// packetHeader is the fixed 48-byte RFC 4330 portion of a Packet, suitable
+// for encoding directly with encoding/binary.
+type packetHeader struct {
+	LiVnMode       uint8
+	Stratum        StratumLevel
+	Poll           PollInterval
+	Precision      PrecisionLevel
+	RootDelay      uint32
+	RootDispersion uint32
+	ReferenceID    uint32
+	RefTimestamp   uint64
+	OrigTimestamp  uint64
+	RecvTimestamp  uint64
+	XmitTimestamp  uint64
+}
+
+// PacketHeaderSize is the wire size of the fixed RFC 4330 portion of a
+// Packet, before any extension fields.
+const PacketHeaderSize = 48
+
+// macSizes are the valid encoded lengths of a legacy RFC 1305 MAC trailer:
+// a 4-byte key ID followed by a 16-byte MD5 or 20-byte SHA1 digest.
+var macSizes = map[int]bool{4 + 16: true, 4 + 20: true}
+
+// MarshalBinary encodes the packet as its 48-byte RFC 4330 header followed
+// by either its RFC 7822 extension fields or its legacy MAC trailer, if
+// either is present.
+func (p *Packet) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	header := packetHeader{
+		LiVnMode:       p.LiVnMode,
+		Stratum:        p.Stratum,
+		Poll:           p.Poll,
+		Precision:      p.Precision,
+		RootDelay:      p.RootDelay,
+		RootDispersion: p.RootDispersion,
+		ReferenceID:    p.ReferenceID,
+		RefTimestamp:   p.RefTimestamp,
+		OrigTimestamp:  p.OrigTimestamp,
+		RecvTimestamp:  p.RecvTimestamp,
+		XmitTimestamp:  p.XmitTimestamp,
+	}
+	if err := binary.Write(&buf, binary.BigEndian, header); err != nil {
+		return nil, err
+	}
+
+	if p.MAC != nil {
+		trailer := make([]byte, 4+len(p.MAC.Digest))
+		binary.BigEndian.PutUint32(trailer[:4], p.MAC.KeyID)
+		copy(trailer[4:], p.MAC.Digest)
+		return append(buf.Bytes(), trailer...), nil
+	}
+
+	extensions, err := MarshalExtensionFields(p.Extensions)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(buf.Bytes(), extensions...), nil
+}
+
+// UnmarshalBinary decodes a packet previously encoded with MarshalBinary. A
+// trailer of exactly 20 or 24 bytes (a key ID plus an MD5 or SHA1 digest) is
+// decoded as a legacy MAC; any other trailer is decoded as RFC 7822
+// extension fields.
+func (p *Packet) UnmarshalBinary(data []byte) error {
+	if len(data) < PacketHeaderSize {
+		return fmt.Errorf("sntp: packet too short: %d bytes", len(data))
+	}
+
+	var header packetHeader
+	if err := binary.Read(bytes.NewReader(data[:PacketHeaderSize]), binary.BigEndian, &header); err != nil {
+		return err
+	}
+
+	trailer := data[PacketHeaderSize:]
+
+	var extensions []ExtensionField
+	var mac *MAC
+	if macSizes[len(trailer)] {
+		mac = &MAC{
+			KeyID:  binary.BigEndian.Uint32(trailer[:4]),
+			Digest: append([]byte(nil), trailer[4:]...),
+		}
+	} else {
+		var err error
+		extensions, err = UnmarshalExtensionFields(trailer)
+		if err != nil {
+			return err
+		}
+	}
+
+	p.LiVnMode = header.LiVnMode
+	p.Stratum = header.Stratum
+	p.Poll = header.Poll
+	p.Precision = header.Precision
+	p.RootDelay = header.RootDelay
+	p.RootDispersion = header.RootDispersion
+	p.ReferenceID = header.ReferenceID
+	p.RefTimestamp = header.RefTimestamp
+	p.OrigTimestamp = header.OrigTimestamp
+	p.RecvTimestamp = header.RecvTimestamp
+	p.XmitTimestamp = header.XmitTimestamp
+	p.Extensions = extensions
+	p.MAC = mac
+
+	return nil
 }
 
 // SetLeapIndicator sets the leap indicator of the packet.
@@ -0,0 +1,191 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package sntp
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/beevik/ntp"
+
+	"github.com/OpenPSG/sntp/auth"
+	"github.com/OpenPSG/sntp/metrics"
+	"github.com/OpenPSG/sntp/nts"
+	"github.com/OpenPSG/sntp/types"
+)
+
+// clockDispersionRate is the maximum clock frequency error (PHI) assumed by
+// RFC 5905 when projecting how much a clock's dispersion grows over time
+// since it was last disciplined.
+const clockDispersionRate = 15e-6
+
+// Option configures optional Server behavior.
+type Option func(*Server)
+
+// WithUpstream configures the server to discipline its clock against the
+// given pool of upstream NTP servers, polling them in turn at the given
+// interval and keeping the result of the first one that responds
+// successfully. Once synchronized, the server advertises
+// Stratum = upstream stratum + 1 (capped at 16, unsynchronized) instead of
+// acting as a stratum 1 source.
+func WithUpstream(pool []string, interval time.Duration) Option {
+	return func(s *Server) {
+		s.upstreamPool = pool
+		s.upstreamInterval = interval
+	}
+}
+
+// WithLocalClockFallback allows the server to advertise its local clock as a
+// stratum 1 source if it has never successfully synchronized with an
+// upstream server, rather than responding with an unsynchronized
+// (LI=AlarmCondition) packet. Has no effect unless WithUpstream is also
+// configured.
+func WithLocalClockFallback() Option {
+	return func(s *Server) {
+		s.fallbackToLocalClock = true
+	}
+}
+
+// WithRecorder configures the server to report instrumentation events to r
+// as it processes requests. By default a Server uses metrics.NoOp, which
+// discards all events; pass metrics.NewCollector() to expose them as
+// Prometheus metrics.
+func WithRecorder(r metrics.Recorder) Option {
+	return func(s *Server) {
+		s.recorder = r
+	}
+}
+
+// WithNTS enables Network Time Security (RFC 8915) for the server. Requests
+// that carry a valid NTS Cookie and Authenticator extension field are
+// answered with a freshly encrypted cookie and authenticator of their own;
+// requests that carry an NTS Cookie but fail verification are rejected with
+// a Kiss-of-Death. Requests without an NTS Cookie are served unauthenticated.
+// keys is typically shared with the server's NTS-KE listener, see
+// nts.NewMasterKeyStore.
+func WithNTS(keys *nts.MasterKeyStore) Option {
+	return func(s *Server) {
+		s.ntsKeys = keys
+	}
+}
+
+// WithKeyStore enables legacy RFC 1305 symmetric-key authentication for the
+// server, for compatibility with NTPv3 clients that predate NTS. A request
+// carrying a MAC is verified against the referenced key before it is
+// answered, and the response is signed with the same key; a request
+// referencing an unknown key is rejected with a Kiss-of-Death NKEY, and one
+// with a MAC that fails to verify is rejected with CRYP.
+func WithKeyStore(keys *auth.KeyStore) Option {
+	return func(s *Server) {
+		s.keyStore = keys
+	}
+}
+
+// upstreamState is a snapshot of the server's most recent successful
+// upstream synchronization.
+type upstreamState struct {
+	synced bool
+
+	stratum     types.StratumLevel
+	referenceID uint32
+
+	offset         time.Duration
+	rootDelay      time.Duration
+	rootDispersion time.Duration
+
+	refTimestamp time.Time
+	lastSync     time.Time
+}
+
+// syncUpstream polls the configured upstream servers until ctx is canceled.
+func (s *Server) syncUpstream(ctx context.Context) {
+	s.pollUpstream()
+
+	ticker := time.NewTicker(s.upstreamInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.pollUpstream()
+		}
+	}
+}
+
+// pollUpstream queries each configured upstream server in turn, recording
+// the result of the first one that responds successfully.
+func (s *Server) pollUpstream() {
+	for _, addr := range s.upstreamPool {
+		resp, err := ntp.Query(addr)
+		if err != nil {
+			slog.Warn("Error querying upstream NTP server", slog.String("addr", addr), slog.Any("error", err))
+			continue
+		}
+
+		if err := resp.Validate(); err != nil {
+			slog.Warn("Rejecting invalid response from upstream NTP server",
+				slog.String("addr", addr), slog.Any("error", err))
+			continue
+		}
+
+		s.upstreamMu.Lock()
+		s.upstream = upstreamState{
+			synced:         true,
+			stratum:        types.StratumLevel(resp.Stratum),
+			referenceID:    resp.ReferenceID,
+			offset:         resp.ClockOffset,
+			rootDelay:      resp.RootDelay + resp.RTT,
+			rootDispersion: resp.RootDispersion,
+			refTimestamp:   resp.ReferenceTime,
+			lastSync:       time.Now(),
+		}
+		s.upstreamMu.Unlock()
+
+		s.recorder.UpstreamSynced()
+		return
+	}
+
+	slog.Error("Failed to sync with any configured upstream NTP server")
+}
+
+// upstreamSnapshot returns the most recent upstream synchronization state.
+func (s *Server) upstreamSnapshot() upstreamState {
+	s.upstreamMu.RLock()
+	defer s.upstreamMu.RUnlock()
+	return s.upstream
+}
+
+// toNTPShort converts a duration to NTP short format: a 32-bit fixed-point
+// number with 16 bits of seconds and 16 bits of fraction.
+func toNTPShort(d time.Duration) uint32 {
+	secs := absDuration(d).Seconds()
+	if secs > math.MaxUint16 {
+		secs = math.MaxUint16
+	}
+	return uint32(secs * (1 << 16))
+}
+
+// fromNTPShort converts a duration encoded in NTP short format back to a
+// time.Duration. It is the inverse of toNTPShort.
+func fromNTPShort(v uint32) time.Duration {
+	return time.Duration(float64(v) / (1 << 16) * float64(time.Second))
+}
+
+// absDuration returns the absolute value of d.
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}